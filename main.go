@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/empty"
 
 	"google.golang.org/grpc"
@@ -38,24 +39,20 @@ func Request(endpoint string) error {
 	return nil
 }
 
-func Director(ctx context.Context, fullMethodName string) (context.Context, []*grpc.ClientConn, error) {
-	md, ok := metadata.FromIncomingContext(ctx)
-	// Copy the inbound metadata explicitly.
-	outCtx, _ := context.WithCancel(ctx)
-	outCtx = metadata.NewOutgoingContext(outCtx, md.Copy())
-	if ok {
-		conn1, err1 := grpc.DialContext(ctx, ":8051", grpc.WithCodec(proxy.Codec()), grpc.WithInsecure())
-		conn2, err2 := grpc.DialContext(ctx, ":8052", grpc.WithCodec(proxy.Codec()), grpc.WithInsecure())
-		var err error
-		if err1 != nil {
-			err = err1
-		} else {
-			err = err2
-		}
-		return outCtx, []*grpc.ClientConn{conn1, conn2}, err
+// backendPool dials each machine backend once and reuses the connection across
+// requests, instead of the historical grpc.DialContext-per-RPC in Director.
+var backendPool = proxy.NewMemPool(
+	proxy.Backend{ID: "serverA", Target: ":8051", DialOpts: []grpc.DialOption{grpc.WithCodec(proxy.Codec()), grpc.WithInsecure()}},
+	proxy.Backend{ID: "serverB", Target: ":8052", DialOpts: []grpc.DialOption{grpc.WithCodec(proxy.Codec()), grpc.WithInsecure()}},
+)
+
+// Director fans every "machine.Machine" call out to both backends in backendPool.
+var Director = proxy.PoolDirector(backendPool, func(ctx context.Context, fullMethodName string) ([]string, error) {
+	if _, ok := metadata.FromIncomingContext(ctx); !ok {
+		return nil, grpc.Errorf(codes.Unimplemented, "Unknown method")
 	}
-	return nil, nil, grpc.Errorf(codes.Unimplemented, "Unknown method")
-}
+	return []string{"serverA", "serverB"}, nil
+})
 
 func RunProxy(endpoint string) {
 	l, err := net.Listen("tcp", endpoint)
@@ -67,7 +64,10 @@ func RunProxy(endpoint string) {
 	// Register a TestService with 4 of its methods explicitly.
 	proxy.RegisterService(server, Director,
 		"machine.Machine",
-		"Version")
+		[]proxy.MethodDesc{{Name: "Version", ClientStreams: false, ServerStreams: false}},
+		proxy.WithResponseFactory(func() proto.Message { return &machine.VersionReply{} }),
+		proxy.WithForwardedHeader("grpc-proxy-poc"),
+		proxy.WithMaxHops(10))
 
 	if err := server.Serve(l); err != nil {
 		log.Fatalf("failed to serve: %v", err)
@@ -0,0 +1,102 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/go-multierror"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// TrailerProxyErrors carries a human-readable summary of the per-backend
+	// failures that were tolerated because at least one sibling backend succeeded.
+	TrailerProxyErrors = "proxy-errors"
+	// TrailerProxyErrorsBin carries the same failures serialized as a ProxyErrors
+	// message, for callers that want structured access instead of parsing text.
+	TrailerProxyErrorsBin = "proxy-errors-bin"
+)
+
+// BackendError tags an error with the backend that produced it (by fan-out index and
+// node identifier: its dial target, or its BackendPool ID when raised by
+// PoolDirector), so it survives being merged into a multierror.Error.
+type BackendError struct {
+	BackendIndex int
+	NodeID       string
+	Err          error
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("backend %d (%s): %v", e.BackendIndex, e.NodeID, e.Err)
+}
+
+// ProxyErrors is the message stashed in the proxy-errors-bin trailer: one Failure
+// per backend that errored while its siblings produced a usable response.
+type ProxyErrors struct {
+	Failures []*ProxyErrors_Failure `protobuf:"bytes,1,rep,name=failures" json:"failures,omitempty"`
+}
+
+func (m *ProxyErrors) Reset()         { *m = ProxyErrors{} }
+func (m *ProxyErrors) String() string { return proto.CompactTextString(m) }
+func (*ProxyErrors) ProtoMessage()    {}
+
+// ProxyErrors_Failure describes a single backend's contribution to a partially
+// failed fan-out call.
+type ProxyErrors_Failure struct {
+	BackendIndex int32  `protobuf:"varint,1,opt,name=backend_index,json=backendIndex" json:"backend_index,omitempty"`
+	NodeId       string `protobuf:"bytes,2,opt,name=node_id,json=nodeId" json:"node_id,omitempty"`
+	Message      string `protobuf:"bytes,3,opt,name=message" json:"message,omitempty"`
+}
+
+func (m *ProxyErrors_Failure) Reset()         { *m = ProxyErrors_Failure{} }
+func (m *ProxyErrors_Failure) String() string { return proto.CompactTextString(m) }
+func (*ProxyErrors_Failure) ProtoMessage()    {}
+
+// statusFromBackendErrors turns the accumulated per-backend errors into a single
+// gRPC status, used when no backend produced a usable response at all, or when a
+// WithAllOrNothing method had any backend fail.
+func statusFromBackendErrors(err error) error {
+	if err == nil {
+		return nil
+	}
+	return grpc.Errorf(codes.Internal, "backends failed: %v", err)
+}
+
+// setProxyErrorsTrailer stashes the tolerated per-backend failures on dst's trailer:
+// a human-readable proxy-errors entry plus, best-effort, a structured
+// proxy-errors-bin ProxyErrors message.
+func setProxyErrorsTrailer(dst grpc.ServerStream, err error) {
+	md := metadata.Pairs(TrailerProxyErrors, err.Error())
+
+	merr, ok := err.(*multierror.Error)
+	if !ok {
+		dst.SetTrailer(md)
+		return
+	}
+
+	pe := &ProxyErrors{}
+	for _, e := range merr.Errors {
+		if be, ok := e.(*BackendError); ok {
+			pe.Failures = append(pe.Failures, &ProxyErrors_Failure{
+				BackendIndex: int32(be.BackendIndex),
+				NodeId:       be.NodeID,
+				Message:      be.Err.Error(),
+			})
+			continue
+		}
+		pe.Failures = append(pe.Failures, &ProxyErrors_Failure{Message: e.Error()})
+	}
+
+	if bin, marshalErr := proto.Marshal(pe); marshalErr == nil {
+		md.Append(TrailerProxyErrorsBin, string(bin))
+	} else {
+		log.Printf("proxy: failed marshalling proxy-errors-bin trailer: %v", marshalErr)
+	}
+	dst.SetTrailer(md)
+}
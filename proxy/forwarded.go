@@ -0,0 +1,93 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	metadataForwarded = "forwarded"
+	metadataRequestID = "x-request-id"
+	metadataProxyHop  = "x-proxy-hop"
+)
+
+// injectForwardedHeaders adds a `forwarded` header,
+// https://en.wikipedia.org/wiki/X-Forwarded-For: it appends an RFC 7239 entry
+// (by=proxyID;for=<peer>;proto=grpc) to any `forwarded` values already present on
+// incomingCtx, stamps a `x-request-id` (generated if the client didn't send one),
+// and increments a per-hop `x-proxy-hop` counter. If maxHops is positive and the
+// incremented counter exceeds it, it returns codes.Aborted instead of a context,
+// since a call that has crossed that many proxies is taken to be in a proxy loop.
+func injectForwardedHeaders(ctx, incomingCtx context.Context, proxyID string, maxHops int) (context.Context, error) {
+	incomingMD, _ := metadata.FromIncomingContext(incomingCtx)
+
+	forwardedFor := "unknown"
+	if p, ok := peer.FromContext(incomingCtx); ok && p.Addr != nil {
+		forwardedFor = p.Addr.String()
+	}
+	entry := fmt.Sprintf("by=%s;for=%s;proto=grpc", proxyID, forwardedFor)
+	forwarded := append(append([]string{}, incomingMD.Get(metadataForwarded)...), entry)
+
+	requestID := firstOrEmpty(incomingMD.Get(metadataRequestID))
+	if requestID == "" {
+		var err error
+		requestID, err = newRequestID()
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "failed generating %s: %v", metadataRequestID, err)
+		}
+	}
+
+	hop := 0
+	if v := firstOrEmpty(incomingMD.Get(metadataProxyHop)); v != "" {
+		hop, _ = strconv.Atoi(v)
+	}
+	hop++
+	if maxHops > 0 && hop > maxHops {
+		return nil, grpc.Errorf(codes.Aborted, "proxy loop detected: %s exceeded max hops (%d)", metadataProxyHop, maxHops)
+	}
+
+	// Overwrite rather than append: ctx's outgoing metadata may already carry a
+	// stale x-request-id/x-proxy-hop, e.g. copied in verbatim by a director such as
+	// PoolDirector. Readers take only the first value (see firstOrEmpty), so joining the freshly
+	// computed values in after that copy would leave the stale ones permanently in
+	// effect and defeat hop counting.
+	out := mdFromOutgoing(ctx).Copy()
+	out.Set(metadataRequestID, requestID)
+	out.Set(metadataProxyHop, strconv.Itoa(hop))
+	out.Set(metadataForwarded, forwarded...)
+	return metadata.NewOutgoingContext(ctx, out), nil
+}
+
+func firstOrEmpty(vals []string) string {
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+func mdFromOutgoing(ctx context.Context) metadata.MD {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		return metadata.MD{}
+	}
+	return md
+}
+
+// newRequestID generates a random 16-byte hex request identifier.
+func newRequestID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", buf), nil
+}
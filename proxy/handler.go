@@ -4,11 +4,16 @@
 package proxy
 
 import (
+	"errors"
 	"io"
 	"log"
 	"sync"
+	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/go-multierror"
 	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 )
@@ -20,19 +25,104 @@ var (
 	}
 )
 
+// ServiceOption configures the behaviour of a RegisterService call, such as how
+// fanned-out unary replies are merged back into a single response.
+type ServiceOption func(*handler)
+
+// WithResponseFactory configures the proxy to unmarshal each backend's reply with
+// factory and merge them via a ResponseMerger (defaultResponseMerger unless
+// WithResponseMerger is also given), instead of the default raw-byte concatenation.
+func WithResponseFactory(factory ResponseFactory) ServiceOption {
+	return func(h *handler) {
+		h.responseFactory = factory
+		if h.merger == nil {
+			h.merger = defaultResponseMerger{}
+		}
+	}
+}
+
+// WithResponseMerger overrides the default, reflection-based ResponseMerger used
+// once a ResponseFactory has been configured via WithResponseFactory.
+func WithResponseMerger(merger ResponseMerger) ServiceOption {
+	return func(h *handler) {
+		h.merger = merger
+	}
+}
+
+// WithAllOrNothing disables partial-failure tolerance for this method: by default a
+// single backend erroring does not sink an RPC as long as at least one other
+// backend produced a response, but methods for which a partial result is useless
+// (e.g. a write that must reach every replica) can opt back into all-or-nothing.
+func WithAllOrNothing() ServiceOption {
+	return func(h *handler) {
+		h.allOrNothing = true
+	}
+}
+
+// WithStreamKind overrides the streaming shape the proxy would otherwise detect for
+// fullMethodName (e.g. "/pkg.Service/Method"), for use with TransparentHandler where
+// there is no registered MethodDesc to consult.
+func WithStreamKind(fullMethodName string, clientStreams, serverStreams bool) ServiceOption {
+	return func(h *handler) {
+		if h.methodDescs == nil {
+			h.methodDescs = map[string]MethodDesc{}
+		}
+		h.methodDescs[fullMethodName] = MethodDesc{ClientStreams: clientStreams, ServerStreams: serverStreams}
+	}
+}
+
+// WithStreamKindLookup supplies a fallback consulted for any method without an
+// explicit MethodDesc, e.g. ServiceInfoStreamKindLookup(server).
+func WithStreamKindLookup(lookup func(fullMethodName string) (MethodDesc, bool)) ServiceOption {
+	return func(h *handler) {
+		h.streamKindLookup = lookup
+	}
+}
+
+// WithTimeout bounds how long the director and the backend calls it starts may run.
+// A backend that has not replied when the timeout expires counts as a failed backend
+// like any other per-backend error: the call still returns the other backends'
+// replies, or fails with codes.Internal if every backend failed or WithAllOrNothing
+// is set.
+func WithTimeout(timeout time.Duration) ServiceOption {
+	return func(h *handler) {
+		h.timeout = timeout
+	}
+}
+
+// WithForwardedHeader enables injection of an RFC 7239 `forwarded` entry
+// (by=proxyID;for=<peer>;proto=grpc), a `x-request-id`, and a `x-proxy-hop` counter
+// into the outgoing context of every backend call. proxyID identifies this proxy
+// instance in the forwarded chain.
+func WithForwardedHeader(proxyID string) ServiceOption {
+	return func(h *handler) {
+		h.forwardedProxyID = proxyID
+	}
+}
+
+// WithMaxHops caps the `x-proxy-hop` counter enabled by WithForwardedHeader: once a
+// call has traversed more than n proxies, it is aborted with codes.Aborted instead
+// of being forwarded again, to break proxy loops.
+func WithMaxHops(n int) ServiceOption {
+	return func(h *handler) {
+		h.maxHops = n
+	}
+}
+
 // RegisterService sets up a proxy handler for a particular gRPC service and method.
 // The behaviour is the same as if you were registering a handler method, e.g. from a codegenerated pb.go file.
 //
 // This can *only* be used if the `server` also uses grpcproxy.CodecForServer() ServerOption.
-func RegisterService(server *grpc.Server, director StreamDirector, serviceName string, methodNames ...string) {
-	streamer := &handler{director}
+func RegisterService(server *grpc.Server, director StreamDirector, serviceName string, methods []MethodDesc, opts ...ServiceOption) {
+	streamer := newHandler(director, opts...)
 	fakeDesc := &grpc.ServiceDesc{
 		ServiceName: serviceName,
 		HandlerType: (*interface{})(nil),
 	}
-	for _, m := range methodNames {
+	for _, m := range methods {
+		streamer.methodDescs["/"+serviceName+"/"+m.Name] = m
 		streamDesc := grpc.StreamDesc{
-			StreamName:    m,
+			StreamName:    m.Name,
 			Handler:       streamer.handler,
 			ServerStreams: true,
 			ClientStreams: true,
@@ -47,13 +137,59 @@ func RegisterService(server *grpc.Server, director StreamDirector, serviceName s
 // backends. It should be used as a `grpc.UnknownServiceHandler`.
 //
 // This can *only* be used if the `server` also uses grpcproxy.CodecForServer() ServerOption.
-func TransparentHandler(director StreamDirector) grpc.StreamHandler {
-	streamer := &handler{director}
+func TransparentHandler(director StreamDirector, opts ...ServiceOption) grpc.StreamHandler {
+	streamer := newHandler(director, opts...)
 	return streamer.handler
 }
 
 type handler struct {
 	director StreamDirector
+
+	// responseFactory and merger, when set, make forwardClientsToServerUnary merge
+	// backend replies via proto reflection instead of concatenating raw wire bytes.
+	responseFactory ResponseFactory
+	merger          ResponseMerger
+
+	// allOrNothing disables partial-failure tolerance; see WithAllOrNothing.
+	allOrNothing bool
+
+	// timeout bounds the director call and everything it starts; see WithTimeout.
+	timeout time.Duration
+
+	// forwardedProxyID and maxHops configure `forwarded`/`x-request-id`/`x-proxy-hop`
+	// injection; see WithForwardedHeader and WithMaxHops. Injection is skipped
+	// entirely when forwardedProxyID is empty.
+	forwardedProxyID string
+	maxHops          int
+
+	// methodDescs holds the known streaming shape per full method name, populated by
+	// RegisterService and/or WithStreamKind. streamKindLookup is consulted for any
+	// method missing from it (see WithStreamKindLookup); methods in neither are
+	// treated as plain unary, matching the proxy's historical behaviour.
+	methodDescs      map[string]MethodDesc
+	streamKindLookup func(fullMethodName string) (MethodDesc, bool)
+}
+
+// methodDesc resolves the streaming shape of fullMethodName, falling back to
+// streamKindLookup and finally to a plain unary MethodDesc.
+func (s *handler) methodDesc(fullMethodName string) MethodDesc {
+	if desc, ok := s.methodDescs[fullMethodName]; ok {
+		return desc
+	}
+	if s.streamKindLookup != nil {
+		if desc, ok := s.streamKindLookup(fullMethodName); ok {
+			return desc
+		}
+	}
+	return MethodDesc{}
+}
+
+func newHandler(director StreamDirector, opts ...ServiceOption) *handler {
+	h := &handler{director: director, methodDescs: map[string]MethodDesc{}}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 // handler is where the real magic of proxying happens.
@@ -66,35 +202,72 @@ func (s *handler) handler(srv interface{}, serverStream grpc.ServerStream) error
 		return grpc.Errorf(codes.Internal, "lowLevelServerStream not exists in context")
 	}
 	// We require that the director's returned context inherits from the serverStream.Context().
-	outgoingCtx, backendConns, err := s.director(serverStream.Context(), fullMethodName)
+	directorCtx := serverStream.Context()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		directorCtx, cancel = context.WithTimeout(directorCtx, s.timeout)
+		defer cancel()
+	}
+	outgoingCtx, backendConns, err := s.director(directorCtx, fullMethodName)
 	if err != nil {
 		return err
 	}
 
+	if s.forwardedProxyID != "" {
+		outgoingCtx, err = injectForwardedHeaders(outgoingCtx, serverStream.Context(), s.forwardedProxyID, s.maxHops)
+		if err != nil {
+			return err
+		}
+	}
+
 	clientCtx, clientCancel := context.WithCancel(outgoingCtx)
-	// TODO(mwitkow): Add a `forwarded` header to metadata, https://en.wikipedia.org/wiki/X-Forwarded-For.
+	// Always released: on every return path below, not just the s2c-error one, so the
+	// backend streams and their goroutines are torn down promptly.
+	defer clientCancel()
 
-	clientStreams := make([]grpc.ClientStream, len(backendConns))
+	clientStreams := make([]grpc.ClientStream, 0, len(backendConns))
+	targets := make([]string, 0, len(backendConns))
+	var setupErrs *multierror.Error
 	for i := range backendConns {
-		clientStreams[i], err = grpc.NewClientStream(clientCtx, clientStreamDescForProxying, backendConns[i], fullMethodName)
+		cs, err := grpc.NewClientStream(clientCtx, clientStreamDescForProxying, backendConns[i], fullMethodName)
 		if err != nil {
-			return err
+			setupErrs = multierror.Append(setupErrs, &BackendError{BackendIndex: i, NodeID: backendConns[i].Target(), Err: err})
+			continue
 		}
+		clientStreams = append(clientStreams, cs)
+		targets = append(targets, backendConns[i].Target())
+	}
+	if len(clientStreams) == 0 {
+		return statusFromBackendErrors(setupErrs.ErrorOrNil())
+	}
+
+	desc := s.methodDesc(fullMethodName)
+	if desc.ClientStreams && len(clientStreams) > 1 {
+		// A client-streaming call may send arbitrarily many frames; multiplexing them
+		// to more than one backend has no well-defined semantics, so refuse it outright
+		// rather than silently proxying to only one of them.
+		return grpc.Errorf(codes.Unimplemented, "fan-out to multiple backends is not supported for client-streaming method %s", fullMethodName)
 	}
 
 	// Explicitly *do not close* s2cErrChan and c2sErrChan, otherwise the select below will not terminate.
 	// Channels do not have to be closed, it is just a control flow mechanism, see
 	// https://groups.google.com/forum/#!msg/golang-nuts/pZwdYRGxCIk/qpbHxRRPJdUJ
-	s2cErrChan := s.forwardServerToClients(serverStream, clientStreams)
-	c2sErrChan := s.forwardClientsToServerUnary(clientStreams, &ServerStreamWrapper{stream: serverStream})
+	s2cErrChan, s2cSendErrs := s.forwardServerToClients(clientCtx, serverStream, targets, clientStreams)
+	var c2sErrChan chan error
+	if desc.ClientStreams {
+		// Client-streaming/bidi: frames must reach the (single) backend as-is, in order.
+		c2sErrChan = s.forwardClientsToServer(clientStreams, &ServerStreamWrapper{stream: serverStream})
+	} else {
+		// Unary or server-streaming-from-the-client's-perspective: the client sends one
+		// frame, so backend replies can be merged into a single response.
+		c2sErrChan = s.forwardClientsToServerUnary(clientCtx, clientStreams, targets, setupErrs, s2cSendErrs, &ServerStreamWrapper{stream: serverStream})
+	}
 	// We don't know which side is going to stop sending first, so we need a select between the two.
 	select {
 	case s2cErr := <-s2cErrChan:
-
 		// however, we may have gotten a receive error (stream disconnected, a read error etc) in which case we need
-		// to cancel the clientStream to the backend, let all of its goroutines be freed up by the CancelFunc and
-		// exit with an error to the stack
-		clientCancel()
+		// to cancel the clientStream to the backend, let all of its goroutines be freed up by the deferred
+		// clientCancel, and exit with an error to the stack
 		return grpc.Errorf(codes.Internal, "failed proxying s2c: %v", s2cErr)
 	case c2sErr := <-c2sErrChan:
 		// c2sErr will contain RPC error from client code. If not io.EOF return the RPC error as server stream error.
@@ -105,19 +278,48 @@ func (s *handler) handler(srv interface{}, serverStream grpc.ServerStream) error
 	}
 }
 
+// mergedPayload carries a single backend's raw reply, tagged with where it came from
+// so it can be merged back into the right slot of the combined proto.
+type mergedPayload struct {
+	backendIndex int
+	nodeID       string
+	payload      []byte
+}
+
 // unary version (need merge)
-func (s *handler) forwardClientsToServerUnary(sources []grpc.ClientStream, dst grpc.ServerStream) chan error {
+//
+// initialErrs carries failures already observed before any backend stream started
+// (e.g. dial/stream-setup errors for backends that never made it into sources), and
+// s2cSendErrs carries the client-to-backend SendMsg failures collected by the
+// sibling forwardServerToClients call, so both are folded into the same
+// partial-failure accounting as this function's own recv/merge errors.
+//
+// Fan-in runs under errgroup.WithContext(ctx): per-backend goroutines never fail the
+// group themselves (a single bad backend is tolerated, see statusFromBackendErrors),
+// but they do respect ctx so a sibling's cancellation (or the caller's) stops them
+// promptly instead of leaking. payloadCh is unbuffered and drained concurrently by a
+// dedicated goroutine, so a backend that sends more than one reply frame can never
+// deadlock waiting for buffer space that only opened up once every backend was done.
+func (s *handler) forwardClientsToServerUnary(ctx context.Context, sources []grpc.ClientStream, targets []string, initialErrs *multierror.Error, s2cSendErrs chan *multierror.Error, dst grpc.ServerStream) chan error {
 	ret := make(chan error, 1)
 
-	var wg sync.WaitGroup
-
-	payloadCh := make(chan []byte, len(sources))
+	var mu sync.Mutex
+	errs := initialErrs
 
-	for i := 0; i < len(sources); i++ {
-		wg.Add(1)
-		go func(i int, src grpc.ClientStream) {
-			defer wg.Done()
+	payloadCh := make(chan mergedPayload)
+	var payloads []mergedPayload
+	drainDone := make(chan struct{})
+	go func() {
+		defer close(drainDone)
+		for p := range payloadCh {
+			payloads = append(payloads, p)
+		}
+	}()
 
+	g, gCtx := errgroup.WithContext(ctx)
+	for i := range sources {
+		i, src := i, sources[i]
+		g.Go(func() error {
 			f := &frame{}
 			for j := 0; ; j++ {
 				if err := src.RecvMsg(f); err != nil {
@@ -126,10 +328,12 @@ func (s *handler) forwardClientsToServerUnary(sources []grpc.ClientStream, dst g
 						// cases we may have received Trailers as part of the call. In case of other errors (stream closed) the trailers
 						// will be nil.
 						dst.SetTrailer(src.Trailer())
-						return
+						return nil
 					}
-					log.Printf("error receiving from client stream: %d %v", i, err)
-					return
+					mu.Lock()
+					errs = multierror.Append(errs, &BackendError{BackendIndex: i, NodeID: targets[i], Err: err})
+					mu.Unlock()
+					return nil
 				}
 				if j == 0 {
 					// This is a bit of a hack, but client to server headers are only readable after first client msg is
@@ -137,29 +341,104 @@ func (s *handler) forwardClientsToServerUnary(sources []grpc.ClientStream, dst g
 					// This is the only place to do it nicely.
 					md, err := src.Header()
 					if err != nil {
-						log.Printf("error getting headers from client stream: %d %v", i, err)
-						return
+						mu.Lock()
+						errs = multierror.Append(errs, &BackendError{BackendIndex: i, NodeID: targets[i], Err: err})
+						mu.Unlock()
+						return nil
 					}
 					if err := dst.SetHeader(md); err != nil {
 						log.Printf("error setting headers from client: %d %v", i, err)
 					}
 				}
 
-				payloadCh <- f.payload
+				select {
+				case payloadCh <- mergedPayload{backendIndex: i, nodeID: targets[i], payload: f.payload}:
+				case <-gCtx.Done():
+					// A cancelled backend is tolerated like any other per-backend failure:
+					// payloads already collected from sibling backends must not be discarded
+					// just because this one got cut off (by the caller giving up, a timeout,
+					// or another backend's own fatal error, if any).
+					mu.Lock()
+					errs = multierror.Append(errs, &BackendError{BackendIndex: i, NodeID: targets[i], Err: gCtx.Err()})
+					mu.Unlock()
+					return nil
+				}
 			}
-		}(i, sources[i])
+		})
 	}
 
 	go func() {
-		wg.Wait()
+		// Per-backend failures, including cancellation, are folded into errs above and
+		// never fail the group, so cancelErr here is reserved for a genuinely unexpected
+		// internal error; there is no such path today, but if one is added later it must
+		// not be mistaken for a per-backend cancellation and report the wrong gRPC code.
+		cancelErr := g.Wait()
 		close(payloadCh)
+		<-drainDone
 
-		var merged []byte
+		if cancelErr != nil {
+			code := codes.Canceled
+			if errors.Is(cancelErr, context.DeadlineExceeded) {
+				code = codes.DeadlineExceeded
+			}
+			ret <- grpc.Errorf(code, "forwarding clients to server: %v", cancelErr)
+			return
+		}
+
+		// Fold in the sibling server-to-clients fan-out's SendMsg failures before
+		// deciding all-or-nothing/merging, so a backend that failed to receive the
+		// client's message counts the same as one that failed to reply to it. The
+		// sibling always sends exactly once, on completion; ctx.Done() is a fallback
+		// in case it's still blocked reading from the original client.
+		select {
+		case sendErrs := <-s2cSendErrs:
+			if sendErrs != nil {
+				mu.Lock()
+				for _, e := range sendErrs.Errors {
+					errs = multierror.Append(errs, e)
+				}
+				mu.Unlock()
+			}
+		case <-ctx.Done():
+		}
+
+		mu.Lock()
+		failErr := errs.ErrorOrNil()
+		mu.Unlock()
+
+		// All-or-nothing methods, or a fan-out where every backend failed, surface the
+		// merged error as the RPC status instead of a (partial or empty) response.
+		if failErr != nil && (s.allOrNothing || len(payloads) == 0) {
+			ret <- statusFromBackendErrors(failErr)
+			return
+		}
 
-		for b := range payloadCh {
-			merged = append(merged, b...)
+		var merged []byte
+		if s.responseFactory == nil {
+			// No ResponseMerger configured (e.g. TransparentHandler with an unknown proto
+			// type): fall back to the historical raw-byte concatenation.
+			for _, p := range payloads {
+				merged = append(merged, p.payload...)
+			}
+		} else {
+			reply := s.responseFactory()
+			for _, p := range payloads {
+				if err := s.merger.Merge(reply, p.backendIndex, p.nodeID, p.payload); err != nil {
+					ret <- grpc.Errorf(codes.Internal, "failed merging backend %d (%s) response: %v", p.backendIndex, p.nodeID, err)
+					return
+				}
+			}
+			var err error
+			merged, err = proto.Marshal(reply)
+			if err != nil {
+				ret <- grpc.Errorf(codes.Internal, "failed marshalling merged response: %v", err)
+				return
+			}
 		}
 
+		if failErr != nil {
+			setProxyErrorsTrailer(dst, failErr)
+		}
 		ret <- dst.SendMsg(&frame{payload: merged})
 	}()
 
@@ -220,30 +499,87 @@ func (s *handler) forwardClientsToServer(sources []grpc.ClientStream, dst grpc.S
 	return ret
 }
 
-func (s *handler) forwardServerToClients(src grpc.ServerStream, destinations []grpc.ClientStream) chan error {
+// forwardServerToClients fans every frame received from src out to all
+// destinations. Each destination is served by its own goroutine under
+// errgroup.WithContext(ctx), so a slow backend never holds up a fast one, and ctx
+// being cancelled (by the sibling c2s fan-in, or the caller) stops all of them
+// promptly instead of leaking a goroutine per backend.
+//
+// The returned error channel keeps its historical meaning: a fatal failure reading
+// from src. Per-destination SendMsg failures are tolerated (a single dead backend
+// must not stop fan-out to its siblings) but are no longer only logged: they are
+// collected as BackendErrors and delivered exactly once, on completion, over the
+// second returned channel, so the caller can fold them into the same
+// partial-failure accounting used for recv/merge errors elsewhere.
+func (s *handler) forwardServerToClients(ctx context.Context, src grpc.ServerStream, targets []string, destinations []grpc.ClientStream) (chan error, chan *multierror.Error) {
 	ret := make(chan error, 1)
+	sendErrsCh := make(chan *multierror.Error, 1)
+
+	var mu sync.Mutex
+	var sendErrs *multierror.Error
+
+	g, gCtx := errgroup.WithContext(ctx)
+	frameChs := make([]chan *frame, len(destinations))
+	for i := range destinations {
+		frameChs[i] = make(chan *frame)
+		i := i
+		g.Go(func() error {
+			for {
+				select {
+				case f, ok := <-frameChs[i]:
+					if !ok {
+						destinations[i].CloseSend()
+						return nil
+					}
+					if err := destinations[i].SendMsg(f); err != nil {
+						// A single dead backend must not stop fan-out to its siblings: record
+						// the failure and keep draining so the recv loop below never blocks on
+						// a dead peer.
+						mu.Lock()
+						sendErrs = multierror.Append(sendErrs, &BackendError{BackendIndex: i, NodeID: targets[i], Err: err})
+						mu.Unlock()
+					}
+				case <-gCtx.Done():
+					// Cancelled the same way a SendMsg failure is tolerated: record it so the
+					// caller's partial-failure accounting and proxy-errors trailer see it too,
+					// instead of a destination that never got the client's last frame(s)
+					// vanishing silently.
+					mu.Lock()
+					sendErrs = multierror.Append(sendErrs, &BackendError{BackendIndex: i, NodeID: targets[i], Err: gCtx.Err()})
+					mu.Unlock()
+					return nil
+				}
+			}
+		})
+	}
+
 	go func() {
 		f := &frame{}
 		for {
 			if err := src.RecvMsg(f); err != nil {
-				if err == io.EOF {
-					// tell clients they should not expect more data
-					for i := range destinations {
-						destinations[i].CloseSend()
-					}
-					return
+				for _, ch := range frameChs {
+					close(ch)
+				}
+				g.Wait()
+
+				mu.Lock()
+				sendErrsCh <- sendErrs
+				mu.Unlock()
+
+				if err != io.EOF {
+					ret <- err
 				}
-				ret <- err
 				return
 			}
 
-			for i := range destinations {
-				if err := destinations[i].SendMsg(f); err != nil {
-					log.Printf("error sending to destination %d: %v", i, err)
-					break
+			next := &frame{payload: f.payload}
+			for _, ch := range frameChs {
+				select {
+				case ch <- next:
+				case <-gCtx.Done():
 				}
 			}
 		}
 	}()
-	return ret
-}
\ No newline at end of file
+	return ret, sendErrsCh
+}
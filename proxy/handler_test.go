@@ -0,0 +1,114 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeClientStream is a minimal grpc.ClientStream double. RecvMsg blocks until either
+// a reply is available or ctx is done, mirroring a real backend stream's behaviour
+// when its context is cancelled out from under it.
+type fakeClientStream struct {
+	ctx     context.Context
+	payload []byte
+	ready   <-chan time.Time
+	done    bool
+}
+
+func (f *fakeClientStream) Header() (metadata.MD, error) { return metadata.MD{}, nil }
+func (f *fakeClientStream) Trailer() metadata.MD         { return metadata.MD{} }
+func (f *fakeClientStream) CloseSend() error             { return nil }
+func (f *fakeClientStream) Context() context.Context     { return f.ctx }
+func (f *fakeClientStream) SendMsg(m interface{}) error  { return nil }
+
+func (f *fakeClientStream) RecvMsg(m interface{}) error {
+	if f.done {
+		return io.EOF
+	}
+	if f.ready != nil {
+		select {
+		case <-f.ready:
+		case <-f.ctx.Done():
+			return f.ctx.Err()
+		}
+	}
+	f.done = true
+	*(m.(*frame)) = frame{payload: f.payload}
+	return nil
+}
+
+// fakeServerStream is a minimal grpc.ServerStream double that records what was sent
+// back to the original client.
+type fakeServerStream struct {
+	mu      sync.Mutex
+	trailer metadata.MD
+	sent    []*frame
+}
+
+func (f *fakeServerStream) SetHeader(md metadata.MD) error  { return nil }
+func (f *fakeServerStream) SendHeader(md metadata.MD) error { return nil }
+func (f *fakeServerStream) Context() context.Context        { return context.Background() }
+func (f *fakeServerStream) RecvMsg(m interface{}) error     { return io.EOF }
+
+func (f *fakeServerStream) SetTrailer(md metadata.MD) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.trailer = metadata.Join(f.trailer, md)
+}
+
+func (f *fakeServerStream) SendMsg(m interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, m.(*frame))
+	return nil
+}
+
+// TestForwardClientsToServerUnary_SlowBackendCancelledClient exercises the
+// errgroup/channel-drain path added for partial-failure tolerance: one backend
+// replies immediately, a second never replies at all, and the client context is
+// cancelled while the slow backend is still pending. The call must still complete
+// (no deadlock on payloadCh), merge in the fast backend's reply, and surface the
+// slow backend's failure via the proxy-errors trailer instead of silently dropping
+// it.
+func TestForwardClientsToServerUnary_SlowBackendCancelledClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fast := &fakeClientStream{ctx: ctx, payload: []byte("fast-reply")}
+	slow := &fakeClientStream{ctx: ctx, ready: make(chan time.Time)} // never fires
+
+	h := newHandler(nil)
+	dst := &fakeServerStream{}
+
+	retCh := h.forwardClientsToServerUnary(ctx, []grpc.ClientStream{fast, slow}, []string{"fast", "slow"}, nil, nil, dst)
+
+	// Give the fast backend's reply a chance to land on payloadCh before the client
+	// gives up, so this exercises "slow backend still pending when the client
+	// cancels", not a race over whether the fast reply is collected at all.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-retCh:
+		if err != nil {
+			t.Fatalf("forwardClientsToServerUnary returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("forwardClientsToServerUnary deadlocked instead of draining after cancellation")
+	}
+
+	if len(dst.sent) != 1 || string(dst.sent[0].payload) != "fast-reply" {
+		t.Fatalf("expected the fast backend's reply to be forwarded, got %+v", dst.sent)
+	}
+	if _, ok := dst.trailer[TrailerProxyErrors]; !ok {
+		t.Fatalf("expected %s trailer recording the slow backend's failure, got %v", TrailerProxyErrors, dst.trailer)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ResponseFactory creates a new, empty instance of a registered method's reply proto
+// message. It is invoked once per RPC to build the accumulator that backend replies
+// are merged into, and is supplied by callers via WithResponseFactory since the proxy
+// itself never link-depends on the generated pb.go types it is forwarding.
+type ResponseFactory func() proto.Message
+
+// ResponseMerger merges the per-backend replies of a fanned-out unary call into a
+// single reply proto, instead of the historical (and only accidentally correct)
+// approach of concatenating raw wire-format bytes.
+type ResponseMerger interface {
+	// Merge unmarshals payload, the raw wire-format bytes received from the backend
+	// at backendIndex (identified by nodeID, e.g. its dial target), into dst.
+	Merge(dst proto.Message, backendIndex int, nodeID string, payload []byte) error
+}
+
+// defaultResponseMerger implements the Talos/Sidero convention: the top-level reply
+// proto carries a single `repeated Response response = 1;` field. Each backend's
+// reply is unmarshalled into a fresh message of dst's type, and its `response`
+// elements are appended to dst's, each with its NodeMetadata hostname stamped from
+// nodeID first if the backend left it empty.
+type defaultResponseMerger struct{}
+
+// Merge unmarshals the backend's reply and appends its `Response` elements onto
+// dst's `Response` slice.
+func (defaultResponseMerger) Merge(dst proto.Message, backendIndex int, nodeID string, payload []byte) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("proxy: response message must be a pointer to struct, got %T", dst)
+	}
+
+	field := rv.Elem().FieldByName("Response")
+	if !field.IsValid() || field.Kind() != reflect.Slice || field.Type().Elem().Kind() != reflect.Ptr {
+		return fmt.Errorf("proxy: %T has no `repeated ... response = 1` field to merge into", dst)
+	}
+
+	// dst is a *T, so a fresh *T is a proto.Message of the same reply type.
+	reply := reflect.New(rv.Elem().Type())
+	if err := proto.Unmarshal(payload, reply.Interface().(proto.Message)); err != nil {
+		return fmt.Errorf("proxy: failed unmarshalling backend %d (%s) response: %v", backendIndex, nodeID, err)
+	}
+
+	elems := reply.Elem().FieldByName("Response")
+	for i := 0; i < elems.Len(); i++ {
+		elem := elems.Index(i)
+		stampNodeMetadata(elem, nodeID)
+		field.Set(reflect.Append(field, elem))
+	}
+	return nil
+}
+
+// stampNodeMetadata sets elem.Metadata.Hostname to nodeID when the backend left it
+// empty, allocating the nested NodeMetadata message if the backend didn't set one.
+// A Hostname the backend already set is kept. It is a no-op for replies that don't
+// carry a `Metadata *NodeMetadata` field.
+func stampNodeMetadata(elem reflect.Value, nodeID string) {
+	if nodeID == "" {
+		return
+	}
+	md := elem.Elem().FieldByName("Metadata")
+	if !md.IsValid() || md.Kind() != reflect.Ptr {
+		return
+	}
+	if md.IsNil() {
+		md.Set(reflect.New(md.Type().Elem()))
+	}
+	hostname := md.Elem().FieldByName("Hostname")
+	if hostname.IsValid() && hostname.Kind() == reflect.String && hostname.String() == "" {
+		hostname.SetString(nodeID)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// testNodeMetadata and testResponseItem/testReply stand in for a generated pb.go's
+// NodeMetadata/Response/Reply types, following the same `repeated Response response
+// = 1` + `Metadata *NodeMetadata` convention defaultResponseMerger targets.
+type testNodeMetadata struct {
+	Hostname string `protobuf:"bytes,1,opt,name=hostname" json:"hostname,omitempty"`
+}
+
+func (m *testNodeMetadata) Reset()         { *m = testNodeMetadata{} }
+func (m *testNodeMetadata) String() string { return proto.CompactTextString(m) }
+func (*testNodeMetadata) ProtoMessage()    {}
+
+type testResponseItem struct {
+	Value    string            `protobuf:"bytes,1,opt,name=value" json:"value,omitempty"`
+	Metadata *testNodeMetadata `protobuf:"bytes,2,opt,name=metadata" json:"metadata,omitempty"`
+}
+
+func (m *testResponseItem) Reset()         { *m = testResponseItem{} }
+func (m *testResponseItem) String() string { return proto.CompactTextString(m) }
+func (*testResponseItem) ProtoMessage()    {}
+
+type testReply struct {
+	Response []*testResponseItem `protobuf:"bytes,1,rep,name=response" json:"response,omitempty"`
+}
+
+func (m *testReply) Reset()         { *m = testReply{} }
+func (m *testReply) String() string { return proto.CompactTextString(m) }
+func (*testReply) ProtoMessage()    {}
+
+func TestDefaultResponseMerger_StampsMissingHostname(t *testing.T) {
+	payload, err := proto.Marshal(&testReply{Response: []*testResponseItem{{Value: "a"}}})
+	if err != nil {
+		t.Fatalf("marshalling fixture: %v", err)
+	}
+
+	dst := &testReply{}
+	if err := (defaultResponseMerger{}).Merge(dst, 0, "nodeA", payload); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+
+	if len(dst.Response) != 1 || dst.Response[0].Value != "a" {
+		t.Fatalf("expected one merged response with Value \"a\", got %+v", dst.Response)
+	}
+	if dst.Response[0].Metadata == nil || dst.Response[0].Metadata.Hostname != "nodeA" {
+		t.Fatalf("expected Metadata.Hostname to be stamped with \"nodeA\", got %+v", dst.Response[0].Metadata)
+	}
+}
+
+func TestDefaultResponseMerger_PreservesExistingHostname(t *testing.T) {
+	payload, err := proto.Marshal(&testReply{Response: []*testResponseItem{{Value: "b", Metadata: &testNodeMetadata{Hostname: "already-set"}}}})
+	if err != nil {
+		t.Fatalf("marshalling fixture: %v", err)
+	}
+
+	dst := &testReply{}
+	if err := (defaultResponseMerger{}).Merge(dst, 1, "nodeB", payload); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+
+	if len(dst.Response) != 1 || dst.Response[0].Metadata.Hostname != "already-set" {
+		t.Fatalf("expected the backend's own Hostname to be preserved, got %+v", dst.Response[0].Metadata)
+	}
+}
+
+func TestDefaultResponseMerger_AppendsAcrossBackends(t *testing.T) {
+	dst := &testReply{}
+	for i, v := range []string{"first", "second"} {
+		payload, err := proto.Marshal(&testReply{Response: []*testResponseItem{{Value: v}}})
+		if err != nil {
+			t.Fatalf("marshalling fixture: %v", err)
+		}
+		if err := (defaultResponseMerger{}).Merge(dst, i, "node", payload); err != nil {
+			t.Fatalf("Merge backend %d: %v", i, err)
+		}
+	}
+
+	if len(dst.Response) != 2 || dst.Response[0].Value != "first" || dst.Response[1].Value != "second" {
+		t.Fatalf("expected both backends' responses appended in order, got %+v", dst.Response)
+	}
+}
+
+func TestDefaultResponseMerger_RejectsMessageWithoutResponseField(t *testing.T) {
+	payload, err := proto.Marshal(&testNodeMetadata{Hostname: "x"})
+	if err != nil {
+		t.Fatalf("marshalling fixture: %v", err)
+	}
+
+	if err := (defaultResponseMerger{}).Merge(&testNodeMetadata{}, 0, "node", payload); err == nil {
+		t.Fatal("expected an error merging into a message with no `Response` field, got nil")
+	}
+}
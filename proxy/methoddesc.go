@@ -0,0 +1,55 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// MethodDesc describes the streaming shape of a single RPC method, mirroring the
+// ClientStreams/ServerStreams flags of grpc.StreamDesc. The proxy uses it to decide
+// whether a call's backend replies can be merged (forwardClientsToServerUnary) or
+// must be interleaved untouched (forwardClientsToServer).
+type MethodDesc struct {
+	Name          string
+	ClientStreams bool
+	ServerStreams bool
+}
+
+// ServiceInfoStreamKindLookup builds a stream-kind lookup from the grpc.ServiceInfo
+// already known to server (server.GetServiceInfo()), for use with
+// WithStreamKindLookup. It only sees services registered on server before this is
+// called, so it is meant for servers that also host their own non-proxied services.
+func ServiceInfoStreamKindLookup(server *grpc.Server) func(fullMethodName string) (MethodDesc, bool) {
+	infos := server.GetServiceInfo()
+	return func(fullMethodName string) (MethodDesc, bool) {
+		serviceName, methodName, ok := splitFullMethodName(fullMethodName)
+		if !ok {
+			return MethodDesc{}, false
+		}
+		info, ok := infos[serviceName]
+		if !ok {
+			return MethodDesc{}, false
+		}
+		for _, m := range info.Methods {
+			if m.Name == methodName {
+				return MethodDesc{Name: methodName, ClientStreams: m.IsClientStream, ServerStreams: m.IsServerStream}, true
+			}
+		}
+		return MethodDesc{}, false
+	}
+}
+
+// splitFullMethodName splits a gRPC full method name ("/pkg.Service/Method") into
+// its service and method parts.
+func splitFullMethodName(fullMethodName string) (serviceName, methodName string, ok bool) {
+	fullMethodName = strings.TrimPrefix(fullMethodName, "/")
+	i := strings.LastIndex(fullMethodName, "/")
+	if i < 0 {
+		return "", "", false
+	}
+	return fullMethodName[:i], fullMethodName[i+1:], true
+}
@@ -0,0 +1,304 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// Backend describes a single dialable proxy target.
+type Backend struct {
+	ID       string
+	Target   string
+	DialOpts []grpc.DialOption
+}
+
+// PoolEventType distinguishes the kinds of membership change a BackendPool can emit.
+type PoolEventType int
+
+const (
+	// PoolEventAdded is sent when a backend becomes available to Get/List.
+	PoolEventAdded PoolEventType = iota
+	// PoolEventRemoved is sent when a backend is evicted from the pool. A backend
+	// turning unhealthy is not evicted and sends no event.
+	PoolEventRemoved
+)
+
+// PoolEvent reports a single backend being added to or removed from a BackendPool.
+type PoolEvent struct {
+	Type    PoolEventType
+	Backend Backend
+}
+
+// BackendPool holds a reusable *grpc.ClientConn per backend instead of a director
+// dialing a fresh connection on every RPC, which exhausts file descriptors and
+// defeats HTTP/2 multiplexing. The in-memory implementation here (NewMemPool) is a
+// default for static or dev configs; for dynamic membership backed by etcd/consul,
+// implement BackendPool directly against their watch APIs and translate changes
+// into PoolEvents.
+type BackendPool interface {
+	// Get returns the (lazily dialed, reused) connection for id, or an error if id is
+	// not known to the pool.
+	Get(ctx context.Context, id string) (*grpc.ClientConn, error)
+	// List returns the currently healthy backends.
+	List(ctx context.Context) ([]Backend, error)
+	// Watch streams add/remove events as pool membership changes. The channel is
+	// closed once ctx is done.
+	Watch(ctx context.Context) <-chan PoolEvent
+}
+
+// memPool is the default in-memory BackendPool. It lazily dials each registered
+// Backend on first Get and keeps the *grpc.ClientConn around for reuse, and
+// subscribes to grpc.health.v1.Health/Watch on each connection so List can filter
+// out backends that stop reporting SERVING.
+type memPool struct {
+	mu       sync.Mutex
+	backends map[string]Backend
+	conns    map[string]*grpc.ClientConn
+	healthy  map[string]bool
+	watchers []chan PoolEvent
+}
+
+// NewMemPool creates an in-memory BackendPool seeded with backends.
+func NewMemPool(backends ...Backend) *memPool {
+	p := &memPool{
+		backends: map[string]Backend{},
+		conns:    map[string]*grpc.ClientConn{},
+		healthy:  map[string]bool{},
+	}
+	for _, b := range backends {
+		p.Add(b)
+	}
+	return p
+}
+
+// Add registers backend b, or replaces the existing registration for b.ID, and
+// notifies watchers. It does not dial; that happens lazily on the first Get.
+func (p *memPool) Add(b Backend) {
+	p.mu.Lock()
+	p.backends[b.ID] = b
+	p.healthy[b.ID] = true
+	p.mu.Unlock()
+
+	p.notify(PoolEvent{Type: PoolEventAdded, Backend: b})
+}
+
+// Remove evicts the backend identified by id, closing its connection if one was
+// dialed, and notifies watchers.
+func (p *memPool) Remove(id string) {
+	p.mu.Lock()
+	b, ok := p.backends[id]
+	conn := p.conns[id]
+	delete(p.backends, id)
+	delete(p.conns, id)
+	delete(p.healthy, id)
+	p.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+	if ok {
+		p.notify(PoolEvent{Type: PoolEventRemoved, Backend: b})
+	}
+}
+
+// Get implements BackendPool.
+func (p *memPool) Get(ctx context.Context, id string) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b, ok := p.backends[id]
+	if !ok {
+		return nil, fmt.Errorf("proxy: unknown backend %q", id)
+	}
+	if conn, ok := p.conns[id]; ok {
+		return conn, nil
+	}
+
+	conn, err := grpc.DialContext(ctx, b.Target, b.DialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: dialing backend %q (%s): %v", id, b.Target, err)
+	}
+	p.conns[id] = conn
+	go p.watchHealth(id, conn)
+	return conn, nil
+}
+
+// List implements BackendPool.
+func (p *memPool) List(ctx context.Context) ([]Backend, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var out []Backend
+	for id, b := range p.backends {
+		if p.healthy[id] {
+			out = append(out, b)
+		}
+	}
+	return out, nil
+}
+
+// Watch implements BackendPool.
+func (p *memPool) Watch(ctx context.Context) <-chan PoolEvent {
+	ch := make(chan PoolEvent, 16)
+
+	p.mu.Lock()
+	p.watchers = append(p.watchers, ch)
+	p.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for i, w := range p.watchers {
+			if w == ch {
+				p.watchers = append(p.watchers[:i], p.watchers[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}()
+
+	return ch
+}
+
+func (p *memPool) notify(ev PoolEvent) {
+	p.mu.Lock()
+	watchers := append([]chan PoolEvent{}, p.watchers...)
+	p.mu.Unlock()
+
+	for _, w := range watchers {
+		select {
+		case w <- ev:
+		default:
+			// A slow watcher must not block pool membership changes for everyone else.
+		}
+	}
+}
+
+// watchHealth subscribes to grpc.health.v1.Health/Watch on conn and tracks id's
+// healthiness accordingly; the connection itself is kept open for reuse even while
+// unhealthy, in case the backend recovers.
+func (p *memPool) watchHealth(id string, conn *grpc.ClientConn) {
+	client := healthpb.NewHealthClient(conn)
+	stream, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		log.Printf("proxy: health watch for backend %q unavailable: %v", id, err)
+		return
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			p.setHealthy(id, false)
+			return
+		}
+		p.setHealthy(id, resp.Status == healthpb.HealthCheckResponse_SERVING)
+	}
+}
+
+func (p *memPool) setHealthy(id string, healthy bool) {
+	p.mu.Lock()
+	if _, ok := p.backends[id]; !ok {
+		p.mu.Unlock()
+		return
+	}
+	changed := p.healthy[id] != healthy
+	p.healthy[id] = healthy
+	p.mu.Unlock()
+
+	if changed && !healthy {
+		log.Printf("proxy: backend %q marked unhealthy", id)
+	}
+}
+
+// PoolDirector returns a StreamDirector that asks selector which backend IDs should
+// receive fullMethodName and resolves each via pool.Get, so callers don't have to
+// hand-write DialContext calls per RPC. As with the rest of the proxy's fan-out
+// paths, it tolerates individual backend failures as long as at least one Get
+// succeeds.
+func PoolDirector(pool BackendPool, selector func(ctx context.Context, fullMethodName string) ([]string, error)) StreamDirector {
+	return func(ctx context.Context, fullMethodName string) (context.Context, []*grpc.ClientConn, error) {
+		ids, err := selector(ctx, fullMethodName)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		outCtx := ctx
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			outCtx = metadata.NewOutgoingContext(outCtx, md.Copy())
+		}
+
+		var errs *multierror.Error
+		var conns []*grpc.ClientConn
+		for i, id := range ids {
+			conn, err := pool.Get(ctx, id)
+			if err != nil {
+				errs = multierror.Append(errs, &BackendError{BackendIndex: i, NodeID: id, Err: err})
+				continue
+			}
+			conns = append(conns, conn)
+		}
+		if len(conns) == 0 {
+			return nil, nil, statusFromBackendErrors(errs.ErrorOrNil())
+		}
+		return outCtx, conns, nil
+	}
+}
+
+// FileBackendPool loads the initial Backend set from a newline-delimited
+// "id target" file (blank lines and lines starting with "#" are ignored), handy for
+// quick starts and docker-compose setups, then behaves exactly like NewMemPool.
+func FileBackendPool(path string) (*memPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: reading backend pool file %q: %v", path, err)
+	}
+
+	var backends []Backend
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("proxy: malformed backend pool line %q, want \"id target\"", line)
+		}
+		backends = append(backends, Backend{ID: fields[0], Target: fields[1], DialOpts: []grpc.DialOption{grpc.WithInsecure()}})
+	}
+	return NewMemPool(backends...), nil
+}
+
+// EnvBackendPool loads the initial Backend set from the comma-separated
+// "id=target" pairs in the envVar environment variable (e.g.
+// "a=10.0.0.1:8051,b=10.0.0.2:8051"), for quick starts without a config file, then
+// behaves exactly like NewMemPool.
+func EnvBackendPool(envVar string) (*memPool, error) {
+	val := os.Getenv(envVar)
+	if val == "" {
+		return NewMemPool(), nil
+	}
+
+	var backends []Backend
+	for _, pair := range strings.Split(val, ",") {
+		idTarget := strings.SplitN(pair, "=", 2)
+		if len(idTarget) != 2 {
+			return nil, fmt.Errorf("proxy: malformed %s entry %q, want \"id=target\"", envVar, pair)
+		}
+		backends = append(backends, Backend{ID: idTarget[0], Target: idTarget[1], DialOpts: []grpc.DialOption{grpc.WithInsecure()}})
+	}
+	return NewMemPool(backends...), nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestMemPool_ListFiltersUnhealthyBackends(t *testing.T) {
+	p := NewMemPool(
+		Backend{ID: "a", Target: "127.0.0.1:0", DialOpts: []grpc.DialOption{grpc.WithInsecure()}},
+		Backend{ID: "b", Target: "127.0.0.1:0", DialOpts: []grpc.DialOption{grpc.WithInsecure()}},
+	)
+
+	p.setHealthy("b", false)
+
+	backends, err := p.List(context.Background())
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(backends) != 1 || backends[0].ID != "a" {
+		t.Fatalf("expected only the healthy backend \"a\" to be listed, got %+v", backends)
+	}
+
+	p.setHealthy("b", true)
+	backends, err = p.List(context.Background())
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(backends) != 2 {
+		t.Fatalf("expected both backends listed once \"b\" recovers, got %+v", backends)
+	}
+}
+
+func TestMemPool_GetUnknownBackend(t *testing.T) {
+	p := NewMemPool()
+	if _, err := p.Get(context.Background(), "missing"); err == nil {
+		t.Fatal("expected an error resolving an unregistered backend ID")
+	}
+}
+
+func TestMemPool_RemoveClosesConnAndEvictsBackend(t *testing.T) {
+	p := NewMemPool(Backend{ID: "a", Target: "127.0.0.1:0", DialOpts: []grpc.DialOption{grpc.WithInsecure()}})
+
+	conn, err := p.Get(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	p.Remove("a")
+
+	if state := conn.GetState(); state != connectivity.Shutdown {
+		t.Fatalf("expected Remove to close the dialed connection, got state %v", state)
+	}
+
+	if _, err := p.Get(context.Background(), "a"); err == nil {
+		t.Fatal("expected Get to fail for a backend removed from the pool")
+	}
+}
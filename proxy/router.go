@@ -0,0 +1,97 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// MethodOption configures a single method registered on a Router. It is the same
+// configuration surface RegisterService uses for a whole service at once (response
+// factory, stream kind, timeout, partial-failure policy); Router just lets it be
+// set one full method name at a time.
+type MethodOption = ServiceOption
+
+// Router dispatches each incoming call to the StreamDirector registered for its full
+// method name ("/pkg.Service/Method"), rather than the one-director-per-
+// RegisterService-call model. It lets a single proxy server host a mix of
+// unary-merged, streaming-fanout, and single-backend-forwarding methods without a
+// hand-written switch inside a user-supplied director.
+type Router struct {
+	methods sync.Map // fullMethodName string -> *handler
+
+	defaultMu       sync.RWMutex
+	defaultDirector StreamDirector
+	defaultOpts     []MethodOption
+}
+
+// NewRouter creates an empty Router. Register methods with RegisterMethod or
+// RegisterService, then use StreamHandler as a grpc.UnknownServiceHandler.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// RegisterMethod registers director, and any MethodOptions, for a single full
+// method name, e.g. "/pkg.Service/Method". desc records the method's streaming
+// shape so the client-streaming fan-out guard in (*handler).handler applies to
+// methods routed here exactly as it does for RegisterService/TransparentHandler.
+func (r *Router) RegisterMethod(fullMethod string, director StreamDirector, desc MethodDesc, opts ...MethodOption) {
+	h := newHandler(director, opts...)
+	h.methodDescs[fullMethod] = desc
+	r.methods.Store(fullMethod, h)
+}
+
+// RegisterService registers director for every MethodDesc in methods under
+// serviceName, equivalent to calling RegisterMethod for each
+// "/serviceName/method.Name" in turn.
+func (r *Router) RegisterService(serviceName string, director StreamDirector, methods []MethodDesc, opts ...MethodOption) {
+	for _, m := range methods {
+		r.RegisterMethod("/"+serviceName+"/"+m.Name, director, m, opts...)
+	}
+}
+
+// SetDefault registers a fallback director used for any full method name with no
+// RegisterMethod/RegisterService entry, instead of failing the call outright.
+func (r *Router) SetDefault(director StreamDirector, opts ...MethodOption) {
+	r.defaultMu.Lock()
+	defer r.defaultMu.Unlock()
+	r.defaultDirector = director
+	r.defaultOpts = opts
+}
+
+// StreamHandler returns a grpc.StreamHandler that looks up the incoming call's full
+// method name and dispatches to its registered director, falling back to the
+// default director (see SetDefault) or codes.Unimplemented if neither is set. Use it
+// as a `grpc.UnknownServiceHandler`.
+func (r *Router) StreamHandler() grpc.StreamHandler {
+	return func(srv interface{}, serverStream grpc.ServerStream) error {
+		fullMethodName, ok := grpc.MethodFromServerStream(serverStream)
+		if !ok {
+			return grpc.Errorf(codes.Internal, "lowLevelServerStream not exists in context")
+		}
+		h := r.handlerFor(fullMethodName)
+		if h == nil {
+			return grpc.Errorf(codes.Unimplemented, "proxy: no director registered for %s", fullMethodName)
+		}
+		return h.handler(srv, serverStream)
+	}
+}
+
+// handlerFor returns the *handler registered for fullMethodName, or one built from
+// the default director if none is registered; nil if there is no default either.
+func (r *Router) handlerFor(fullMethodName string) *handler {
+	if v, ok := r.methods.Load(fullMethodName); ok {
+		return v.(*handler)
+	}
+
+	r.defaultMu.RLock()
+	defer r.defaultMu.RUnlock()
+	if r.defaultDirector == nil {
+		return nil
+	}
+	return newHandler(r.defaultDirector, r.defaultOpts...)
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package proxy
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestRouter_HandlerForUnregisteredWithNoDefault(t *testing.T) {
+	r := NewRouter()
+	if h := r.handlerFor("/pkg.Service/Method"); h != nil {
+		t.Fatalf("expected no handler for an unregistered method with no default, got %+v", h)
+	}
+}
+
+func TestRouter_HandlerForFallsBackToDefault(t *testing.T) {
+	wantErr := errors.New("default director invoked")
+	r := NewRouter()
+	r.SetDefault(func(ctx context.Context, fullMethodName string) (context.Context, []*grpc.ClientConn, error) {
+		return nil, nil, wantErr
+	})
+
+	h := r.handlerFor("/pkg.Service/Unregistered")
+	if h == nil {
+		t.Fatal("expected the default director to back an unregistered method")
+	}
+	if _, _, err := h.director(context.Background(), "/pkg.Service/Unregistered"); err != wantErr {
+		t.Fatalf("expected handlerFor's handler to use the default director, got err %v", err)
+	}
+}
+
+func TestRouter_RegisterMethodPopulatesMethodDesc(t *testing.T) {
+	wantErr := errors.New("registered director invoked")
+	director := func(ctx context.Context, fullMethodName string) (context.Context, []*grpc.ClientConn, error) {
+		return nil, nil, wantErr
+	}
+
+	r := NewRouter()
+	r.RegisterMethod("/pkg.Service/Upload", director, MethodDesc{Name: "Upload", ClientStreams: true})
+
+	h := r.handlerFor("/pkg.Service/Upload")
+	if h == nil {
+		t.Fatal("expected a handler for the registered method")
+	}
+	if desc := h.methodDesc("/pkg.Service/Upload"); !desc.ClientStreams {
+		t.Fatalf("expected the registered MethodDesc to mark ClientStreams, got %+v", desc)
+	}
+	if _, _, err := h.director(context.Background(), "/pkg.Service/Upload"); err != wantErr {
+		t.Fatalf("expected the registered director to be wired in, got err %v", err)
+	}
+}
+
+func TestRouter_RegisterServicePopulatesMethodDescPerMethod(t *testing.T) {
+	director := func(ctx context.Context, fullMethodName string) (context.Context, []*grpc.ClientConn, error) {
+		return nil, nil, nil
+	}
+
+	r := NewRouter()
+	r.RegisterService("pkg.Service", director, []MethodDesc{
+		{Name: "Get", ClientStreams: false, ServerStreams: false},
+		{Name: "Upload", ClientStreams: true, ServerStreams: false},
+	})
+
+	if desc := r.handlerFor("/pkg.Service/Get").methodDesc("/pkg.Service/Get"); desc.ClientStreams {
+		t.Fatalf("expected Get to be registered as non-client-streaming, got %+v", desc)
+	}
+	if desc := r.handlerFor("/pkg.Service/Upload").methodDesc("/pkg.Service/Upload"); !desc.ClientStreams {
+		t.Fatalf("expected Upload to be registered as client-streaming, got %+v", desc)
+	}
+}